@@ -0,0 +1,75 @@
+package ingester
+
+import (
+	"runtime"
+	"sync"
+)
+
+// concurrentCutThreshold is the number of pending complete traces an
+// instance must exceed before it fans cut-and-flush work out across
+// cutPool instead of writing them one at a time on the calling goroutine.
+// At or below this, the overhead of splitting work across workers outweighs the
+// benefit.
+const concurrentCutThreshold = 256
+
+// cutPool is a bounded worker pool shared across every tenant instance so
+// a multi-tenant ingester with hundreds of instances doesn't serialize all
+// of their flush work behind one goroutine each. Instances with
+// concurrentCutThreshold or fewer pending traces skip the pool entirely.
+var cutPool = newCutWorkerPool(runtime.NumCPU())
+
+type cutWorkerPool struct {
+	sem chan struct{}
+}
+
+func newCutWorkerPool(size int) *cutWorkerPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &cutWorkerPool{sem: make(chan struct{}, size)}
+}
+
+// cutConcurrent fans cutTrace out across the pool for every (fingerprint,
+// trace) pair in pending. WALManager.Append does its own locking around
+// the bookkeeping it needs, so workers here don't need to merge anything
+// back into the instance themselves; they only need to run cutTrace
+// concurrently instead of in a single serial loop. A trace is removed
+// from i.traces only once its own cut succeeds, so one trace failing
+// doesn't cost the rest of the batch their place in the map. Returns the
+// first error encountered, if any.
+func (p *cutWorkerPool) cutConcurrent(i *instance, pending map[traceFingerprint]*trace) error {
+	type result struct {
+		fp  traceFingerprint
+		err error
+	}
+	results := make(chan result, len(pending))
+
+	var wg sync.WaitGroup
+	wg.Add(len(pending))
+	for fp, tr := range pending {
+		fp, tr := fp, tr
+		p.sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-p.sem }()
+			results <- result{fp: fp, err: i.cutTrace(tr)}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var firstErr error
+	for r := range results {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		i.tracesMtx.Lock()
+		delete(i.traces, r.fp)
+		i.tracesMtx.Unlock()
+	}
+
+	return firstErr
+}
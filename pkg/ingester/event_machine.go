@@ -0,0 +1,365 @@
+package ingester
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/joe-elliott/frigg/pkg/friggpb"
+)
+
+// eventKind identifies the type of event flowing through the eventMachine.
+type eventKind int
+
+const (
+	eventTraceReceived eventKind = iota
+	eventTraceExpired
+	eventTraceReleased
+	eventBlockReady
+)
+
+// overflowPolicy controls what happens when the event channel is full.
+type overflowPolicy int
+
+const (
+	// overflowBlock blocks the producer until the channel has room.
+	overflowBlock overflowPolicy = iota
+	// overflowDropOldest drops the oldest queued event to make room for the new one.
+	overflowDropOldest
+)
+
+// event is the unit of work processed by the eventMachine's worker.
+type event struct {
+	kind eventKind
+
+	ctx     context.Context
+	traceID traceFingerprint
+	req     *friggpb.PushRequest
+
+	// errCh, when non-nil, receives the outcome of handling this event.
+	// Push uses this to surface limiter/push errors synchronously to the
+	// caller without itself taking tracesMtx.
+	errCh chan error
+}
+
+var (
+	eventQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "frigg",
+		Name:      "ingester_event_queue_depth",
+		Help:      "The number of events currently queued for processing.",
+	}, []string{"tenant"})
+
+	eventsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frigg",
+		Name:      "ingester_events_dropped_total",
+		Help:      "The total number of events dropped because the event queue was full.",
+	}, []string{"tenant"})
+
+	eventLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frigg",
+		Name:      "ingester_event_latency_seconds",
+		Help:      "Time spent processing a single event, by kind.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"tenant", "kind"})
+
+	cutRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frigg",
+		Name:      "ingester_cut_retries_total",
+		Help:      "The total number of times an expired trace's cut failed and was rescheduled instead of being discarded.",
+	}, []string{"tenant"})
+)
+
+// eventMachine replaces the polling CutCompleteTraces/IsBlockReady model with
+// a single worker goroutine draining a bounded, typed event channel. The
+// caller-facing hot path (Push) only ever enqueues an event; the map
+// mutation Push and trace expiry cause happens on the worker, under
+// tracesMtx. CutCompleteTraces still removes cut traces from i.traces on
+// its own goroutine, also under tracesMtx.
+type eventMachine struct {
+	instance *instance
+
+	events   chan event
+	overflow overflowPolicy
+
+	expiryMtx sync.Mutex
+	expiry    *expiryHeap
+	cutoff    time.Duration
+
+	wakeExpiry chan struct{}
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	depth      prometheus.Gauge
+	dropped    prometheus.Counter
+	latencyFor func(eventKind) prometheus.Observer
+}
+
+// expiryEntry tracks when a trace should be cut if no further spans arrive.
+type expiryEntry struct {
+	traceID  traceFingerprint
+	expireAt time.Time
+}
+
+// expiryHeap is a min-heap ordered by expireAt, used so the timer goroutine
+// only ever has to look at the soonest-expiring trace instead of scanning
+// the full trace map every tick.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expireAt.Before(h[j].expireAt) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(*expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+	return entry
+}
+
+func newEventMachine(i *instance, queueSize int, cutoff time.Duration, overflow overflowPolicy) *eventMachine {
+	h := &expiryHeap{}
+	heap.Init(h)
+
+	em := &eventMachine{
+		instance:   i,
+		events:     make(chan event, queueSize),
+		overflow:   overflow,
+		expiry:     h,
+		cutoff:     cutoff,
+		wakeExpiry: make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		depth:      eventQueueDepth.WithLabelValues(i.instanceID),
+		dropped:    eventsDroppedTotal.WithLabelValues(i.instanceID),
+		latencyFor: func(k eventKind) prometheus.Observer {
+			return eventLatency.WithLabelValues(i.instanceID, eventKindName(k))
+		},
+	}
+
+	em.wg.Add(2)
+	go em.worker()
+	go em.expiryLoop()
+
+	return em
+}
+
+func eventKindName(k eventKind) string {
+	switch k {
+	case eventTraceReceived:
+		return "trace_received"
+	case eventTraceExpired:
+		return "trace_expired"
+	case eventTraceReleased:
+		return "trace_released"
+	case eventBlockReady:
+		return "block_ready"
+	default:
+		return "unknown"
+	}
+}
+
+// enqueue submits an event for processing, applying the configured
+// overflow policy if the channel is full.
+func (em *eventMachine) enqueue(ev event) {
+	select {
+	case em.events <- ev:
+		em.depth.Set(float64(len(em.events)))
+		return
+	default:
+	}
+
+	switch em.overflow {
+	case overflowDropOldest:
+		select {
+		case <-em.events:
+			em.dropped.Inc()
+		default:
+		}
+		select {
+		case em.events <- ev:
+		default:
+			em.dropped.Inc()
+		}
+	default: // overflowBlock
+		em.events <- ev
+	}
+	em.depth.Set(float64(len(em.events)))
+}
+
+// worker drains the event channel and applies each event to i.traces under
+// tracesMtx, making Push lock-free from the caller's perspective.
+func (em *eventMachine) worker() {
+	defer em.wg.Done()
+
+	for {
+		select {
+		case ev := <-em.events:
+			em.depth.Set(float64(len(em.events)))
+			start := time.Now()
+			em.handle(ev)
+			em.latencyFor(ev.kind).Observe(time.Since(start).Seconds())
+		case <-em.quit:
+			return
+		}
+	}
+}
+
+func (em *eventMachine) handle(ev event) {
+	i := em.instance
+
+	switch ev.kind {
+	case eventTraceReceived:
+		i.tracesMtx.Lock()
+		_, exists := i.traces[ev.traceID]
+		tr, err := i.getOrCreateTraceLocked(ev.ctx, ev.traceID, ev.req)
+		i.tracesMtx.Unlock()
+		if err != nil {
+			if ev.errCh != nil {
+				ev.errCh <- err
+			}
+			return
+		}
+
+		if err := tr.Push(ev.ctx, ev.req); err != nil {
+			if ev.errCh != nil {
+				ev.errCh <- err
+			}
+			return
+		}
+
+		em.maybeScheduleExpiry(ev.traceID, exists, tr.lastAppend.Add(em.cutoff))
+
+		if ev.errCh != nil {
+			ev.errCh <- nil
+		}
+
+	case eventTraceExpired:
+		i.tracesMtx.Lock()
+		tr, ok := i.traces[ev.traceID]
+		if !ok {
+			i.tracesMtx.Unlock()
+			return
+		}
+		if time.Now().Before(tr.lastAppend.Add(em.cutoff)) {
+			// span arrived since this timer was scheduled; reschedule
+			i.tracesMtx.Unlock()
+			em.scheduleExpiry(ev.traceID, tr.lastAppend.Add(em.cutoff))
+			return
+		}
+		i.tracesMtx.Unlock()
+
+		// Don't delete the trace until its cut actually succeeds: cutTrace
+		// can fail transiently (e.g. the WALManager's in-flight byte
+		// budget), and losing a trace permanently because the manager was
+		// briefly under load is worse than cutting it a little late.
+		if err := i.cutTrace(tr); err != nil {
+			cutRetriesTotal.WithLabelValues(i.instanceID).Inc()
+			em.scheduleExpiry(ev.traceID, time.Now().Add(em.cutoff))
+			return
+		}
+
+		i.tracesMtx.Lock()
+		delete(i.traces, ev.traceID)
+		i.tracesMtx.Unlock()
+
+		em.enqueue(event{kind: eventBlockReady})
+
+	case eventTraceReleased:
+		i.tracesMtx.Lock()
+		delete(i.traces, ev.traceID)
+		i.tracesMtx.Unlock()
+
+	case eventBlockReady:
+		// no-op placeholder; block readiness is observed via IsBlockReady
+		// by the flush loop. Kept as an event so future handoff logic has
+		// a single place to hook in without touching the hot path.
+	}
+}
+
+// maybeScheduleExpiry schedules an expiry entry for fp the first time it's
+// seen, i.e. when existed is false. existed must reflect whether fp was
+// already present in i.traces *before* this event's getOrCreateTraceLocked
+// ran; handle() passes that through rather than re-deriving it here.
+//
+// This is split out of handle()'s eventTraceReceived case specifically so
+// the existed/!existed branch — inverted once already, which left traces
+// never expiring on their own — is unit-testable on its own, without
+// needing a full instance/Limiter/trace pipeline to drive handle() end to
+// end.
+func (em *eventMachine) maybeScheduleExpiry(fp traceFingerprint, existed bool, expireAt time.Time) {
+	if existed {
+		return
+	}
+	em.scheduleExpiry(fp, expireAt)
+}
+
+// scheduleExpiry pushes an entry onto the expiry heap and wakes the timer
+// goroutine if the new entry is now the soonest to expire.
+func (em *eventMachine) scheduleExpiry(traceID traceFingerprint, expireAt time.Time) {
+	em.expiryMtx.Lock()
+	heap.Push(em.expiry, &expiryEntry{traceID: traceID, expireAt: expireAt})
+	em.expiryMtx.Unlock()
+
+	select {
+	case em.wakeExpiry <- struct{}{}:
+	default:
+	}
+}
+
+// expiryLoop is the timer goroutine. It always sleeps until the soonest
+// expiry in the heap rather than polling the whole trace map on a fixed
+// tick.
+func (em *eventMachine) expiryLoop() {
+	defer em.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		em.expiryMtx.Lock()
+		var wait time.Duration
+		if em.expiry.Len() > 0 {
+			next := (*em.expiry)[0]
+			wait = time.Until(next.expireAt)
+			if wait < 0 {
+				wait = 0
+			}
+		} else {
+			wait = time.Hour
+		}
+		em.expiryMtx.Unlock()
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+			em.expiryMtx.Lock()
+			var due []traceFingerprint
+			for em.expiry.Len() > 0 && !(*em.expiry)[0].expireAt.After(time.Now()) {
+				entry := heap.Pop(em.expiry).(*expiryEntry)
+				due = append(due, entry.traceID)
+			}
+			em.expiryMtx.Unlock()
+
+			for _, traceID := range due {
+				em.enqueue(event{kind: eventTraceExpired, traceID: traceID})
+			}
+		case <-em.wakeExpiry:
+			// loop around and re-evaluate the soonest expiry
+		case <-em.quit:
+			return
+		}
+	}
+}
+
+// stop terminates the worker and timer goroutines. It does not drain the
+// event channel; callers that need a final flush should call
+// CutCompleteTraces with immediate=true before stopping.
+func (em *eventMachine) stop() {
+	close(em.quit)
+	em.wg.Wait()
+}
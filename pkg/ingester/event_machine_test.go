@@ -0,0 +1,112 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestExpiryHeapOrdersBySoonestFirst guards the invariant expiryLoop relies
+// on to avoid polling the full trace map: the heap must always surface the
+// soonest-expiring entry at index 0, regardless of push order.
+func TestExpiryHeapOrdersBySoonestFirst(t *testing.T) {
+	// Expiry times must lie in the future: the running expiryLoop pops any
+	// entry that is already due, which would race with the length check.
+	now := time.Now()
+	i := &instance{instanceID: "test"}
+	em := newEventMachine(i, 16, time.Minute, overflowBlock)
+	defer em.stop()
+
+	em.scheduleExpiry(traceFingerprint(3), now.Add(3*time.Second))
+	em.scheduleExpiry(traceFingerprint(1), now.Add(1*time.Second))
+	em.scheduleExpiry(traceFingerprint(2), now.Add(2*time.Second))
+
+	em.expiryMtx.Lock()
+	defer em.expiryMtx.Unlock()
+
+	if got := em.expiry.Len(); got != 3 {
+		t.Fatalf("expiry heap len = %d, want 3", got)
+	}
+	if got := (*em.expiry)[0].traceID; got != traceFingerprint(1) {
+		t.Fatalf("soonest entry = %v, want traceFingerprint(1)", got)
+	}
+}
+
+// TestEventMachineSchedulesExpiryOnceForNewTrace is a regression test for a
+// bug where the worker's comma-ok exists check was inverted: it scheduled
+// expiry for traces already present in i.traces and skipped scheduling for
+// genuinely new ones, so traces never expired on their own. A trace should
+// get exactly one expiry entry the first time it's seen.
+//
+// This drives the real maybeScheduleExpiry method handle() calls for
+// eventTraceReceived, rather than hand-rolling the exists/!exists check
+// inline: a test that re-implements the logic it's guarding would keep
+// passing even if the inversion were reintroduced in handle() itself.
+func TestEventMachineSchedulesExpiryOnceForNewTrace(t *testing.T) {
+	i := &instance{instanceID: "test"}
+	em := newEventMachine(i, 16, time.Minute, overflowBlock)
+	defer em.stop()
+
+	fp := traceFingerprint(42)
+	now := time.Now()
+
+	// First sighting of fp: existed is false, so this must schedule.
+	em.maybeScheduleExpiry(fp, false, now.Add(em.cutoff))
+	// Every later event for the same fingerprint sees it already tracked.
+	em.maybeScheduleExpiry(fp, true, now.Add(em.cutoff))
+
+	em.expiryMtx.Lock()
+	defer em.expiryMtx.Unlock()
+	if got := em.expiry.Len(); got != 1 {
+		t.Fatalf("expiry heap len = %d, want exactly 1 entry scheduled for a trace seen twice", got)
+	}
+}
+
+// TestMaybeScheduleExpirySkipsExisting guards maybeScheduleExpiry directly:
+// called with existed=true it must never push onto the expiry heap,
+// regardless of how many times it's called.
+func TestMaybeScheduleExpirySkipsExisting(t *testing.T) {
+	i := &instance{instanceID: "test"}
+	em := newEventMachine(i, 16, time.Minute, overflowBlock)
+	defer em.stop()
+
+	fp := traceFingerprint(7)
+	now := time.Now()
+
+	em.maybeScheduleExpiry(fp, true, now.Add(em.cutoff))
+	em.maybeScheduleExpiry(fp, true, now.Add(em.cutoff))
+
+	em.expiryMtx.Lock()
+	defer em.expiryMtx.Unlock()
+	if got := em.expiry.Len(); got != 0 {
+		t.Fatalf("expiry heap len = %d, want 0: existed=true must never schedule", got)
+	}
+}
+
+// TestEnqueueOverflowDropOldest guards the drop-oldest overflow policy: once
+// the channel is full, enqueue must make room for the newest event rather
+// than blocking the eventMachine worker's caller forever.
+func TestEnqueueOverflowDropOldest(t *testing.T) {
+	i := &instance{instanceID: "test"}
+	em := &eventMachine{
+		instance: i,
+		events:   make(chan event, 1),
+		overflow: overflowDropOldest,
+		depth:    eventQueueDepth.WithLabelValues("test"),
+		dropped:  eventsDroppedTotal.WithLabelValues("test"),
+		latencyFor: func(k eventKind) prometheus.Observer {
+			return eventLatency.WithLabelValues("test", eventKindName(k))
+		},
+	}
+
+	em.enqueue(event{kind: eventBlockReady, traceID: traceFingerprint(1)})
+	em.enqueue(event{kind: eventBlockReady, traceID: traceFingerprint(2)})
+
+	if got := len(em.events); got != 1 {
+		t.Fatalf("queue len = %d, want 1 under overflowDropOldest", got)
+	}
+	if got := (<-em.events).traceID; got != traceFingerprint(2) {
+		t.Fatalf("surviving event traceID = %v, want the newest (2), not the dropped oldest", got)
+	}
+}
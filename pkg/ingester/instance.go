@@ -1,18 +1,19 @@
 package ingester
 
 import (
-	"bytes"
 	"context"
+	"fmt"
 	"net/http"
-	"sort"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/weaveworks/common/httpgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 
 	"github.com/joe-elliott/frigg/pkg/friggpb"
 	"github.com/joe-elliott/frigg/pkg/ingester/wal"
@@ -35,122 +36,243 @@ var (
 		Name:      "ingester_traces_created_total",
 		Help:      "The total number of traces created per tenant.",
 	}, []string{"tenant"})
+
+	blockSymbolTableBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "frigg",
+		Name:      "ingester_block_symbol_table_bytes",
+		Help:      "The size of the in-progress block's symbol table, in bytes.",
+	}, []string{"tenant"})
+
+	blockSymbolTableEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "frigg",
+		Name:      "ingester_block_symbol_table_entries",
+		Help:      "The number of entries in the in-progress block's symbol table.",
+	}, []string{"tenant"})
 )
 
+// defaultEventQueueSize bounds the number of in-flight events per instance
+// before the configured overflowPolicy kicks in.
+const defaultEventQueueSize = 1000
+
 type instance struct {
 	tracesMtx sync.Mutex
 	traces    map[traceFingerprint]*trace
 
-	blockTracesMtx sync.RWMutex
-	traceRecords   []*storage.TraceRecord
-	walBlock       wal.WALBlock
-	lastBlockCut   time.Time
+	instanceID             string
+	tracesCreatedTotal     prometheus.Counter
+	symbolTableBytesMetric prometheus.Gauge
+	symbolTableEntryMetric prometheus.Gauge
+	limiter                *Limiter
+	manager                *WALManager
+	tracer                 oteltrace.Tracer
 
-	instanceID         string
-	tracesCreatedTotal prometheus.Counter
-	limiter            *Limiter
-	wal                wal.WAL
+	events *eventMachine
 }
 
-func newInstance(instanceID string, limiter *Limiter, wal wal.WAL) *instance {
+func newInstance(instanceID string, limiter *Limiter, manager *WALManager, cutoff time.Duration, tracing TracingConfig) *instance {
 	i := &instance{
-		traces:       map[traceFingerprint]*trace{},
-		lastBlockCut: time.Now(),
-
-		instanceID:         instanceID,
-		tracesCreatedTotal: tracesCreatedTotal.WithLabelValues(instanceID),
-		limiter:            limiter,
-		wal:                wal,
+		traces: map[traceFingerprint]*trace{},
+
+		instanceID:             instanceID,
+		tracesCreatedTotal:     tracesCreatedTotal.WithLabelValues(instanceID),
+		symbolTableBytesMetric: blockSymbolTableBytes.WithLabelValues(instanceID),
+		symbolTableEntryMetric: blockSymbolTableEntries.WithLabelValues(instanceID),
+		limiter:                limiter,
+		manager:                manager,
+		tracer:                 newTracer(tracing),
 	}
-	i.ResetBlock()
+	i.events = newEventMachine(i, defaultEventQueueSize, cutoff, overflowBlock)
 	return i
 }
 
+// Push enqueues a traceReceived event and waits for the worker to apply it.
+// Unlike the previous implementation, Push itself never takes tracesMtx:
+// the map update it causes happens on the single eventMachine worker
+// goroutine, so the hot path is lock-free from the caller's perspective.
 func (i *instance) Push(ctx context.Context, req *friggpb.PushRequest) error {
-	i.tracesMtx.Lock()
-	defer i.tracesMtx.Unlock()
+	ctx, span := i.tracer.Start(ctx, "instance.Push")
+	defer span.End()
 
-	trace, err := i.getOrCreateTrace(req)
-	if err != nil {
-		return err
+	if len(req.Spans) == 0 {
+		return nil
 	}
 
-	if err := trace.Push(ctx, req); err != nil {
+	fp := traceFingerprint(util.Fingerprint(req.Spans[0].TraceID))
+	span.SetAttributes(tenantAttr(i.instanceID), attribute.String("trace_id", fmt.Sprintf("%x", req.Spans[0].TraceID)))
+
+	errCh := make(chan error, 1)
+	i.events.enqueue(event{
+		kind:    eventTraceReceived,
+		ctx:     ctx,
+		traceID: fp,
+		req:     req,
+		errCh:   errCh,
+	})
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
 		return err
+	case <-ctx.Done():
+		span.SetStatus(codes.Error, ctx.Err().Error())
+		return ctx.Err()
 	}
-
-	return nil
 }
 
-// Moves any complete traces out of the map to complete traces
-func (i *instance) CutCompleteTraces(cutoff time.Duration, immediate bool) error {
+// CutCompleteTraces, with immediate set, forces a cut of every in-flight
+// trace; with immediate false it returns nil without cutting anything. It
+// is used by the flush loop when shutting down or rotating a block; steady
+// state expiry is now driven by the eventMachine's expiry heap instead of a
+// full map scan.
+//
+// The heavy lifting of owning segments, symbol tables and write locking now
+// belongs to the WALManager; CutCompleteTraces is a thin wrapper that hands
+// each trace to manager.Append. Instances with more than
+// concurrentCutThreshold pending traces fan those Append calls out across
+// the shared cutPool instead of making them serially. A trace is only
+// removed from i.traces once its own cut succeeds, and every trace in the
+// batch is attempted even if an earlier one fails, so a transient failure
+// (e.g. the WALManager's in-flight byte budget) leaves just that trace
+// behind for the next call instead of silently discarding the whole batch.
+func (i *instance) CutCompleteTraces(immediate bool) error {
+	_, span := i.tracer.Start(context.Background(), "instance.CutCompleteTraces")
+	defer span.End()
+	span.SetAttributes(tenantAttr(i.instanceID))
+
+	if !immediate {
+		return nil
+	}
+
 	i.tracesMtx.Lock()
-	defer i.tracesMtx.Unlock()
+	pending := make(map[traceFingerprint]*trace, len(i.traces))
+	for fp, tr := range i.traces {
+		pending[fp] = tr
+	}
+	i.tracesMtx.Unlock()
+
+	span.SetAttributes(attribute.Int("trace_count", len(pending)))
+
+	var cutErr error
+	if len(pending) > concurrentCutThreshold {
+		cutErr = cutPool.cutConcurrent(i, pending)
+	} else {
+		for fp, tr := range pending {
+			if err := i.cutTrace(tr); err != nil {
+				if cutErr == nil {
+					cutErr = err
+				}
+				continue
+			}
+			i.tracesMtx.Lock()
+			delete(i.traces, fp)
+			i.tracesMtx.Unlock()
+		}
+	}
 
-	i.blockTracesMtx.Lock()
-	defer i.blockTracesMtx.Unlock()
+	span.SetAttributes(attribute.Int("block_trace_records", i.manager.OpenSegmentRecordCount(i.instanceID)))
 
-	now := time.Now()
-	for key, trace := range i.traces {
-		if now.Add(cutoff).After(trace.lastAppend) || immediate {
-			start, length, err := i.walBlock.Write(trace.trace)
-			if err != nil {
-				return err
-			}
+	if cutErr != nil {
+		span.SetStatus(codes.Error, cutErr.Error())
+		return cutErr
+	}
 
-			// insert sorted
-			idx := sort.Search(len(i.traceRecords), func(idx int) bool {
-				return bytes.Compare(i.traceRecords[idx].TraceID, trace.traceID) == -1
-			})
-			i.traceRecords = append(i.traceRecords, nil)
-			copy(i.traceRecords[idx+1:], i.traceRecords[idx:])
-			i.traceRecords[idx] = &storage.TraceRecord{
-				TraceID: trace.traceID,
-				Start:   start,
-				Length:  length,
-			}
+	return nil
+}
 
-			delete(i.traces, key)
-		}
+// cutTrace hands a single trace to the WALManager, which owns the open
+// segment, its symbol table and the sorted insertion into that segment's
+// trace records.
+func (i *instance) cutTrace(trace *trace) error {
+	_, err := i.manager.Append(i.instanceID, trace.traceID, trace.trace)
+	if err != nil {
+		return err
 	}
 
+	tableBytes, tableEntries := i.manager.SymbolTableStats(i.instanceID)
+	i.symbolTableBytesMetric.Set(float64(tableBytes))
+	i.symbolTableEntryMetric.Set(float64(tableEntries))
+
 	return nil
 }
 
+// IsBlockReady delegates to the WALManager, which tracks each tenant's
+// open-segment age and size directly instead of the instance maintaining
+// its own lastBlockCut.
 func (i *instance) IsBlockReady(maxTracesPerBlock int, maxBlockLifetime time.Duration) bool {
-	i.blockTracesMtx.RLock()
-	defer i.blockTracesMtx.RUnlock()
+	_, span := i.tracer.Start(context.Background(), "instance.IsBlockReady")
+	defer span.End()
 
-	now := time.Now()
-	return len(i.traceRecords) >= maxTracesPerBlock || i.lastBlockCut.Add(maxBlockLifetime).Before(now)
+	ready := i.manager.IsReady(i.instanceID, maxTracesPerBlock, maxBlockLifetime)
+	span.SetAttributes(tenantAttr(i.instanceID), attribute.Bool("ready", ready))
+
+	return ready
 }
 
-// GetBlock() returns complete traces.  It is up to the caller to do something sensible at this point
-func (i *instance) GetBlock() ([]*storage.TraceRecord, wal.WALBlock) {
-	i.blockTracesMtx.Lock()
-	defer i.blockTracesMtx.Unlock()
+// GetBlock closes the tenant's open segment if it's ready and returns the
+// oldest segment the WALManager has finished for this tenant, if any,
+// along with the SymbolTable the querier needs to resolve the block's
+// varint string references lazily.
+//
+// Unlike the pre-WALManager implementation, callers don't need to call
+// ResetBlock before GetBlock to see a ready block: GetBlock does that
+// close itself, so there's no window between IsBlockReady reporting true
+// and the segment actually landing in the finished queue for a caller to
+// race against the periodic flushLoop. ResetBlock remains for callers,
+// like shutdown, that need to force a cut regardless of readiness.
+func (i *instance) GetBlock(maxTracesPerBlock int, maxBlockLifetime time.Duration) ([]*storage.TraceRecord, wal.WALBlock, *wal.SymbolTable, bool) {
+	if i.manager.IsReady(i.instanceID, maxTracesPerBlock, maxBlockLifetime) {
+		i.manager.Close(i.instanceID)
+	}
 
-	return i.traceRecords, i.walBlock
-}
+	seg, ok := i.manager.PopFinished(i.instanceID)
+	if !ok {
+		return nil, nil, nil, false
+	}
 
-func (i *instance) ResetBlock() error {
-	i.blockTracesMtx.Lock()
-	defer i.blockTracesMtx.Unlock()
+	return seg.records, seg.block, seg.symbolTable, true
+}
 
-	i.traceRecords = make([]*storage.TraceRecord, 0) //todo : init this with some value?  max traces per block?
+// GetVerifiedBlock is GetBlock plus an opt-in VerifyBlock pass. In strict
+// mode a block that fails verification is returned alongside the error,
+// not discarded, so the caller can still quarantine it instead of
+// shipping it to object storage; in lenient mode the failure is only
+// recorded via the verification-failures metric and the block is handed
+// back as usual.
+func (i *instance) GetVerifiedBlock(ctx context.Context, mode BlockVerificationMode, maxTracesPerBlock int, maxBlockLifetime time.Duration) ([]*storage.TraceRecord, wal.WALBlock, *wal.SymbolTable, bool, error) {
+	records, block, symbolTable, ok := i.GetBlock(maxTracesPerBlock, maxBlockLifetime)
+	if !ok {
+		return nil, nil, nil, false, nil
+	}
 
-	if i.walBlock != nil {
-		i.walBlock.Clear()
+	if err := VerifyBlock(ctx, i.instanceID, mode, block, records); err != nil {
+		return records, block, symbolTable, false, err
 	}
 
-	var err error
-	i.walBlock, err = i.wal.NewBlock(uuid.New(), i.instanceID)
-	return err
+	return records, block, symbolTable, true, nil
 }
 
-func (i *instance) getOrCreateTrace(req *friggpb.PushRequest) (*trace, error) {
+// ResetBlock forces the WALManager to rotate the tenant's open segment,
+// pushing it onto the finished queue for the next GetBlock call.
+func (i *instance) ResetBlock() error {
+	_, span := i.tracer.Start(context.Background(), "instance.ResetBlock")
+	defer span.End()
+	span.SetAttributes(tenantAttr(i.instanceID))
+
+	i.manager.Close(i.instanceID)
+
+	return nil
+}
+
+// getOrCreateTraceLocked looks up (or creates) the trace for fp. Callers
+// must hold i.tracesMtx; it is only ever called from the eventMachine
+// worker, so Push does not need to take the lock itself.
+func (i *instance) getOrCreateTraceLocked(ctx context.Context, fp traceFingerprint, req *friggpb.PushRequest) (*trace, error) {
+	_, span := i.tracer.Start(ctx, "instance.getOrCreateTrace")
+	defer span.End()
+
 	traceID := req.Spans[0].TraceID // two assumptions here should hold.  distributor separates spans by traceid.  0 length span slices should be filtered before here
-	fp := traceFingerprint(util.Fingerprint(traceID))
 
 	trace, ok := i.traces[fp]
 	if ok {
@@ -159,6 +281,7 @@ func (i *instance) getOrCreateTrace(req *friggpb.PushRequest) (*trace, error) {
 
 	err := i.limiter.AssertMaxTracesPerUser(i.instanceID, len(i.traces))
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		return nil, httpgrpc.Errorf(http.StatusTooManyRequests, err.Error())
 	}
 
@@ -0,0 +1,169 @@
+package ingester
+
+import (
+	"context"
+
+	"go.opentelemetry.io/collector/consumer/pdata"
+
+	"github.com/joe-elliott/frigg/pkg/friggpb"
+)
+
+// PushOTLP accepts a batch of OTLP ResourceSpans and routes each trace
+// within the batch through the normal Push path. The OTLP wire format
+// batches spans across many traces in a single payload, whereas Push (and
+// getOrCreateTraceLocked) assume a single trace per request, so the batch
+// is re-split by trace ID here before entering the instance.
+func (i *instance) PushOTLP(ctx context.Context, traces pdata.Traces) error {
+	for _, req := range splitOTLPByTraceID(traces) {
+		if err := i.Push(ctx, req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitOTLPByTraceID converts OTLP ResourceSpans into one friggpb.PushRequest
+// per trace ID, preserving resource attributes, scope information, span
+// kind, status, and events/links on each converted span rather than
+// flattening them away.
+func splitOTLPByTraceID(traces pdata.Traces) []*friggpb.PushRequest {
+	byTraceID := make(map[string][]*friggpb.Span)
+	order := make([]string, 0)
+
+	rss := traces.ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		rs := rss.At(i)
+		resource := rs.Resource()
+
+		ilss := rs.InstrumentationLibrarySpans()
+		for j := 0; j < ilss.Len(); j++ {
+			ils := ilss.At(j)
+			scope := ils.InstrumentationLibrary()
+
+			spans := ils.Spans()
+			for k := 0; k < spans.Len(); k++ {
+				span := spanFromOTLP(spans.At(k), resource, scope)
+
+				key := string(span.TraceID)
+				if _, ok := byTraceID[key]; !ok {
+					order = append(order, key)
+				}
+				byTraceID[key] = append(byTraceID[key], span)
+			}
+		}
+	}
+
+	reqs := make([]*friggpb.PushRequest, 0, len(order))
+	for _, key := range order {
+		reqs = append(reqs, &friggpb.PushRequest{
+			Spans: byTraceID[key],
+		})
+	}
+
+	return reqs
+}
+
+// spanFromOTLP translates a single OTLP span, together with its owning
+// resource and instrumentation scope, into the internal span
+// representation used to build trace objects.
+func spanFromOTLP(otSpan pdata.Span, resource pdata.Resource, scope pdata.InstrumentationLibrary) *friggpb.Span {
+	span := &friggpb.Span{
+		TraceID:      otSpan.TraceID().Bytes(),
+		SpanID:       otSpan.SpanID().Bytes(),
+		ParentSpanID: otSpan.ParentSpanID().Bytes(),
+		Name:         otSpan.Name(),
+		Kind:         spanKindFromOTLP(otSpan.Kind()),
+		StartTime:    uint64(otSpan.StartTimestamp()),
+		EndTime:      uint64(otSpan.EndTimestamp()),
+		Status: &friggpb.Status{
+			Code:    statusCodeFromOTLP(otSpan.Status().Code()),
+			Message: otSpan.Status().Message(),
+		},
+		Resource: resourceAttributesFromOTLP(resource),
+		Scope: &friggpb.InstrumentationScope{
+			Name:    scope.Name(),
+			Version: scope.Version(),
+		},
+		Attributes: attributesFromOTLP(otSpan.Attributes()),
+		Events:     eventsFromOTLP(otSpan.Events()),
+		Links:      linksFromOTLP(otSpan.Links()),
+	}
+
+	return span
+}
+
+// spanKindFromOTLP translates an OTLP span kind into its friggpb
+// equivalent explicitly rather than by numeric cast: the two enums are
+// defined independently of each other and nothing guarantees their
+// ordinals stay aligned as either proto evolves.
+func spanKindFromOTLP(kind pdata.SpanKind) friggpb.SpanKind {
+	switch kind {
+	case pdata.SpanKindInternal:
+		return friggpb.SpanKind_SPAN_KIND_INTERNAL
+	case pdata.SpanKindServer:
+		return friggpb.SpanKind_SPAN_KIND_SERVER
+	case pdata.SpanKindClient:
+		return friggpb.SpanKind_SPAN_KIND_CLIENT
+	case pdata.SpanKindProducer:
+		return friggpb.SpanKind_SPAN_KIND_PRODUCER
+	case pdata.SpanKindConsumer:
+		return friggpb.SpanKind_SPAN_KIND_CONSUMER
+	default:
+		return friggpb.SpanKind_SPAN_KIND_UNSPECIFIED
+	}
+}
+
+// statusCodeFromOTLP translates an OTLP status code into its friggpb
+// equivalent explicitly, for the same reason as spanKindFromOTLP: the
+// two enums are independently defined protos with no guaranteed ordinal
+// alignment.
+func statusCodeFromOTLP(code pdata.StatusCode) friggpb.StatusCode {
+	switch code {
+	case pdata.StatusCodeOk:
+		return friggpb.StatusCode_STATUS_CODE_OK
+	case pdata.StatusCodeError:
+		return friggpb.StatusCode_STATUS_CODE_ERROR
+	default:
+		return friggpb.StatusCode_STATUS_CODE_UNSET
+	}
+}
+
+func resourceAttributesFromOTLP(resource pdata.Resource) map[string]string {
+	return attributesFromOTLP(resource.Attributes())
+}
+
+func attributesFromOTLP(attrs pdata.AttributeMap) map[string]string {
+	out := make(map[string]string, attrs.Len())
+	attrs.Range(func(k string, v pdata.AttributeValue) bool {
+		out[k] = v.AsString()
+		return true
+	})
+	return out
+}
+
+func eventsFromOTLP(events pdata.SpanEventSlice) []*friggpb.Event {
+	out := make([]*friggpb.Event, 0, events.Len())
+	for i := 0; i < events.Len(); i++ {
+		e := events.At(i)
+		out = append(out, &friggpb.Event{
+			Name:       e.Name(),
+			Time:       uint64(e.Timestamp()),
+			Attributes: attributesFromOTLP(e.Attributes()),
+		})
+	}
+	return out
+}
+
+func linksFromOTLP(links pdata.SpanLinkSlice) []*friggpb.Link {
+	out := make([]*friggpb.Link, 0, links.Len())
+	for i := 0; i < links.Len(); i++ {
+		l := links.At(i)
+		out = append(out, &friggpb.Link{
+			TraceID:    l.TraceID().Bytes(),
+			SpanID:     l.SpanID().Bytes(),
+			Attributes: attributesFromOTLP(l.Attributes()),
+		})
+	}
+	return out
+}
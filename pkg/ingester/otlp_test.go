@@ -0,0 +1,67 @@
+package ingester
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/collector/consumer/pdata"
+
+	"github.com/joe-elliott/frigg/pkg/friggpb"
+)
+
+// TestSpanKindFromOTLPMapsKnownKinds guards the explicit, non-cast
+// translation between the OTLP and friggpb span kind enums: nothing ties
+// their ordinals together, so a numeric cast would silently drift if
+// either proto adds or reorders values.
+func TestSpanKindFromOTLPMapsKnownKinds(t *testing.T) {
+	if got := spanKindFromOTLP(pdata.SpanKindInternal); got != friggpb.SpanKind_SPAN_KIND_INTERNAL {
+		t.Fatalf("spanKindFromOTLP(Internal) = %v, want SPAN_KIND_INTERNAL", got)
+	}
+	if got := spanKindFromOTLP(pdata.SpanKindServer); got != friggpb.SpanKind_SPAN_KIND_SERVER {
+		t.Fatalf("spanKindFromOTLP(Server) = %v, want SPAN_KIND_SERVER", got)
+	}
+	if got := spanKindFromOTLP(pdata.SpanKindClient); got != friggpb.SpanKind_SPAN_KIND_CLIENT {
+		t.Fatalf("spanKindFromOTLP(Client) = %v, want SPAN_KIND_CLIENT", got)
+	}
+	if got := spanKindFromOTLP(pdata.SpanKindProducer); got != friggpb.SpanKind_SPAN_KIND_PRODUCER {
+		t.Fatalf("spanKindFromOTLP(Producer) = %v, want SPAN_KIND_PRODUCER", got)
+	}
+	if got := spanKindFromOTLP(pdata.SpanKindConsumer); got != friggpb.SpanKind_SPAN_KIND_CONSUMER {
+		t.Fatalf("spanKindFromOTLP(Consumer) = %v, want SPAN_KIND_CONSUMER", got)
+	}
+}
+
+// TestSpanKindFromOTLPDefaultsToUnspecified guards the default case: an
+// OTLP kind this translation doesn't recognize (including the zero value,
+// SpanKindUnspecified) must fall back to SPAN_KIND_UNSPECIFIED rather than
+// zero-casting into whatever friggpb.SpanKind happens to have ordinal 0.
+func TestSpanKindFromOTLPDefaultsToUnspecified(t *testing.T) {
+	if got := spanKindFromOTLP(pdata.SpanKindUnspecified); got != friggpb.SpanKind_SPAN_KIND_UNSPECIFIED {
+		t.Fatalf("spanKindFromOTLP(Unspecified) = %v, want SPAN_KIND_UNSPECIFIED", got)
+	}
+	if got := spanKindFromOTLP(pdata.SpanKind(99)); got != friggpb.SpanKind_SPAN_KIND_UNSPECIFIED {
+		t.Fatalf("spanKindFromOTLP(99) = %v, want SPAN_KIND_UNSPECIFIED for an unrecognized ordinal", got)
+	}
+}
+
+// TestStatusCodeFromOTLPMapsKnownCodes guards the same explicit mapping
+// for status codes.
+func TestStatusCodeFromOTLPMapsKnownCodes(t *testing.T) {
+	if got := statusCodeFromOTLP(pdata.StatusCodeOk); got != friggpb.StatusCode_STATUS_CODE_OK {
+		t.Fatalf("statusCodeFromOTLP(Ok) = %v, want STATUS_CODE_OK", got)
+	}
+	if got := statusCodeFromOTLP(pdata.StatusCodeError); got != friggpb.StatusCode_STATUS_CODE_ERROR {
+		t.Fatalf("statusCodeFromOTLP(Error) = %v, want STATUS_CODE_ERROR", got)
+	}
+}
+
+// TestStatusCodeFromOTLPDefaultsToUnset mirrors
+// TestSpanKindFromOTLPDefaultsToUnspecified for the status code mapping's
+// default branch.
+func TestStatusCodeFromOTLPDefaultsToUnset(t *testing.T) {
+	if got := statusCodeFromOTLP(pdata.StatusCodeUnset); got != friggpb.StatusCode_STATUS_CODE_UNSET {
+		t.Fatalf("statusCodeFromOTLP(Unset) = %v, want STATUS_CODE_UNSET", got)
+	}
+	if got := statusCodeFromOTLP(pdata.StatusCode(99)); got != friggpb.StatusCode_STATUS_CODE_UNSET {
+		t.Fatalf("statusCodeFromOTLP(99) = %v, want STATUS_CODE_UNSET for an unrecognized ordinal", got)
+	}
+}
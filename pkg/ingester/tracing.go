@@ -0,0 +1,43 @@
+package ingester
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig controls the OpenTelemetry tracer the ingester uses to
+// self-instrument its own hot path (Push, CutCompleteTraces, etc). The
+// zero value disables self-instrumentation so tests, and deployments that
+// don't run an OTel collector, get a no-op tracer with no overhead.
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// SamplingFraction is the fraction (0.0-1.0) of self-instrumentation
+	// spans to keep. Only consulted when Enabled is true; defaults to
+	// sampling nothing (0) if left unset, so operators must opt in
+	// explicitly rather than being surprised by trace volume.
+	SamplingFraction float64 `yaml:"sampling_fraction"`
+}
+
+// newTracer builds the tracer an instance uses to instrument its own
+// operations. It never touches the process-wide global tracer provider so
+// self-instrumentation can be enabled or disabled per ingester without
+// affecting anything else in the binary that pulls a tracer from otel.Tracer.
+func newTracer(cfg TracingConfig) oteltrace.Tracer {
+	if !cfg.Enabled {
+		return oteltrace.NewNoopTracerProvider().Tracer("frigg/ingester")
+	}
+
+	provider := trace.NewTracerProvider(
+		trace.WithSampler(trace.TraceIDRatioBased(cfg.SamplingFraction)),
+	)
+
+	return provider.Tracer("frigg/ingester")
+}
+
+// tenantAttr is the attribute every self-instrumentation span on instance
+// carries so spans can be correlated back to the tenant that produced them.
+func tenantAttr(tenant string) attribute.KeyValue {
+	return attribute.String("tenant", tenant)
+}
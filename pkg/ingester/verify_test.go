@@ -0,0 +1,64 @@
+package ingester
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestVerifyBlockOffSkipsVerification guards the VerificationOff fast path:
+// it must return before ever touching block or records, since callers pass
+// a real wal.WALBlock there in production and this mode exists specifically
+// to avoid paying the verification cost at all.
+func TestVerifyBlockOffSkipsVerification(t *testing.T) {
+	if err := VerifyBlock(context.Background(), "test-tenant", VerificationOff, nil, nil); err != nil {
+		t.Fatalf("VerifyBlock with VerificationOff = %v, want nil", err)
+	}
+}
+
+// TestVerifyBlockNoRecordsSucceeds guards the loop-not-entered case: a
+// block with no records has nothing to check and should report success in
+// both strict and lenient mode without dereferencing block.
+func TestVerifyBlockNoRecordsSucceeds(t *testing.T) {
+	if err := VerifyBlock(context.Background(), "test-tenant", VerificationStrict, nil, nil); err != nil {
+		t.Fatalf("VerifyBlock(strict, no records) = %v, want nil", err)
+	}
+	if err := VerifyBlock(context.Background(), "test-tenant", VerificationLenient, nil, nil); err != nil {
+		t.Fatalf("VerifyBlock(lenient, no records) = %v, want nil", err)
+	}
+}
+
+// TestReportVerificationFailureStrictReturnsError guards the branch
+// VerifyBlock relies on for every failure kind (checksum_mismatch,
+// decode_failed, trace_id_mismatch, unsorted_records): in strict mode the
+// reason must come back as an error the caller can quarantine the block
+// on, not just a metric bump.
+func TestReportVerificationFailureStrictReturnsError(t *testing.T) {
+	err := reportVerificationFailure("test-tenant", VerificationStrict, "checksum_mismatch")
+	if err == nil {
+		t.Fatalf("reportVerificationFailure(strict) = nil, want an error the caller can quarantine the block on")
+	}
+	if !strings.Contains(err.Error(), "checksum_mismatch") {
+		t.Fatalf("reportVerificationFailure(strict) error = %q, want it to name the failure reason", err.Error())
+	}
+}
+
+// TestReportVerificationFailureLenientReturnsNil guards the opposite side:
+// lenient mode must record the failure (via the counter, exercised
+// incidentally here) but let the caller proceed with handoff.
+func TestReportVerificationFailureLenientReturnsNil(t *testing.T) {
+	if err := reportVerificationFailure("test-tenant", VerificationLenient, "decode_failed"); err != nil {
+		t.Fatalf("reportVerificationFailure(lenient) = %v, want nil so handoff proceeds", err)
+	}
+}
+
+// TestReportVerificationFailureOffReturnsNil guards the remaining mode
+// value: VerifyBlock never calls reportVerificationFailure when mode is
+// off, but the function itself should still only turn a failure into an
+// error for VerificationStrict specifically, not "anything that isn't
+// lenient".
+func TestReportVerificationFailureOffReturnsNil(t *testing.T) {
+	if err := reportVerificationFailure("test-tenant", VerificationOff, "trace_id_mismatch"); err != nil {
+		t.Fatalf("reportVerificationFailure(off) = %v, want nil", err)
+	}
+}
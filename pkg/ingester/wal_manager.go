@@ -0,0 +1,424 @@
+package ingester
+
+import (
+	"bytes"
+	"container/heap"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/joe-elliott/frigg/pkg/friggpb"
+	"github.com/joe-elliott/frigg/pkg/ingester/wal"
+	"github.com/joe-elliott/frigg/pkg/storage"
+)
+
+// WALManagerConfig controls segment rotation and backpressure for the
+// shared WALManager.
+type WALManagerConfig struct {
+	// MaxSegmentAge closes a tenant's open segment once it has been open
+	// this long, even if MaxSegmentTraces hasn't been reached.
+	MaxSegmentAge time.Duration
+	// MaxSegmentTraces closes a tenant's open segment once it holds this
+	// many trace records.
+	MaxSegmentTraces int
+	// MaxInFlightBytes bounds the total payload bytes buffered across all
+	// tenants' open segments. Append returns a 429 once this is exceeded,
+	// giving the distributor something to back off on.
+	MaxInFlightBytes int64
+}
+
+// AppendResult is the handle returned by WALManager.Append. Append is
+// synchronous in this implementation (the write completes before it
+// returns), but it's modeled as a result type rather than a bare
+// (start, length) pair so a future async manager can return a handle the
+// caller awaits instead of changing the Append signature again.
+type AppendResult struct {
+	Start  uint32
+	Length uint32
+}
+
+// finishedSegment is a closed segment's records together with the block
+// and symbol table a caller needs to ship it to object storage.
+type finishedSegment struct {
+	sequence uint64
+	tenant   string
+
+	records     []*storage.TraceRecord
+	block       wal.WALBlock
+	symbolTable *wal.SymbolTable
+}
+
+// finishedQueue is a min-heap of finished segments ordered by completion
+// order, so tenants are handed off to storage in the order their segments
+// closed rather than in map-iteration order.
+type finishedQueue []*finishedSegment
+
+func (q finishedQueue) Len() int            { return len(q) }
+func (q finishedQueue) Less(i, j int) bool  { return q[i].sequence < q[j].sequence }
+func (q finishedQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *finishedQueue) Push(x interface{}) { *q = append(*q, x.(*finishedSegment)) }
+func (q *finishedQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	seg := old[n-1]
+	*q = old[:n-1]
+	return seg
+}
+
+// tenantSegment is the state WALManager keeps for a tenant's currently
+// open segment. block.Write itself is not serialized by recordsMtx: the
+// wal package's WALBlock is expected to allocate write offsets safely
+// under concurrent callers on its own, so multiple cutPool workers
+// appending to the same tenant's segment can actually run in parallel
+// instead of queuing on a single per-segment lock. recordsMtx only ever
+// guards the bookkeeping below (records, bytes, closed), never the write
+// itself.
+type tenantSegment struct {
+	recordsMtx sync.Mutex
+	records    []*storage.TraceRecord
+	bytes      int64
+	// closed is set under recordsMtx once this segment has been removed
+	// from WALManager.open. An Append that resolved this segment before
+	// the removal must check closed (also under recordsMtx) before
+	// writing to it, and retry against a freshly opened segment if it's
+	// true, rather than writing into a segment already handed off to the
+	// finished queue.
+	closed bool
+	// inFlight counts Append calls that observed closed == false and are
+	// between that check and recording their write's result. closeSegment
+	// waits on it before finalizing the symbol table and snapshotting
+	// records/bytes, so a write that started just before the close wins
+	// the race instead of being silently lost.
+	inFlight sync.WaitGroup
+
+	block       wal.WALBlock
+	symbolTable *wal.SymbolTable
+	opened      time.Time
+}
+
+// WALManager owns every open segment across every tenant, replacing the
+// model where each instance directly held its own wal.WALBlock. It exposes
+// Append for the append-side hot path and a flush loop that rotates
+// segments based on age, size, or an explicit Close call rather than each
+// instance tracking its own lastBlockCut. Centralizing ownership here
+// means a single fsync per segment can be shared across tenants and gives
+// a natural place to enforce an in-flight byte budget.
+type WALManager struct {
+	cfg WALManagerConfig
+	wal wal.WAL
+
+	mtx      sync.Mutex
+	open     map[string]*tenantSegment
+	finished map[string]*finishedQueue
+	sequence uint64
+
+	inFlightBytesMtx sync.Mutex
+	inFlightBytes    int64
+
+	quit chan struct{}
+}
+
+func NewWALManager(cfg WALManagerConfig, w wal.WAL) *WALManager {
+	m := &WALManager{
+		cfg:      cfg,
+		wal:      w,
+		open:     map[string]*tenantSegment{},
+		finished: map[string]*finishedQueue{},
+		quit:     make(chan struct{}),
+	}
+
+	go m.flushLoop()
+
+	return m
+}
+
+// Append writes a trace to the tenant's open segment, opening one if
+// necessary, and returns its location within that segment. If the
+// manager's in-flight byte budget is exceeded it returns a 429 so the
+// caller (ultimately the distributor) can back off instead of the
+// ingester buffering unboundedly.
+//
+// The segment lookup and the closed check are the only parts of this
+// serialized against a concurrent Close/rotateStale; the write itself
+// runs unlocked so concurrent Appends to the same tenant's segment (e.g.
+// fanned out by cutPool) make real progress in parallel instead of
+// queuing on one mutex. If the segment closes out from under an Append
+// that already resolved it but hasn't registered as in-flight yet, the
+// closed check catches it and retries against the segment the next
+// segmentForLocked call creates.
+func (m *WALManager) Append(tenant string, traceID []byte, t *friggpb.Trace) (AppendResult, error) {
+	approxBytes := int64(t.Size())
+
+	if !m.reserveBytes(approxBytes) {
+		return AppendResult{}, httpgrpc.Errorf(http.StatusTooManyRequests, "wal manager in-flight byte budget exceeded")
+	}
+
+	for {
+		m.mtx.Lock()
+		seg, err := m.segmentForLocked(tenant)
+		if err != nil {
+			m.mtx.Unlock()
+			m.releaseBytes(approxBytes)
+			return AppendResult{}, err
+		}
+
+		seg.recordsMtx.Lock()
+		if seg.closed {
+			seg.recordsMtx.Unlock()
+			m.mtx.Unlock()
+			continue
+		}
+		seg.inFlight.Add(1)
+		seg.recordsMtx.Unlock()
+		m.mtx.Unlock()
+
+		start, length, err := seg.block.Write(t, seg.symbolTable)
+		if err != nil {
+			seg.inFlight.Done()
+			m.releaseBytes(approxBytes)
+			return AppendResult{}, err
+		}
+
+		seg.recordsMtx.Lock()
+		seg.bytes += approxBytes
+		seg.records = insertRecordSorted(seg.records, &storage.TraceRecord{
+			TraceID: traceID,
+			Start:   start,
+			Length:  length,
+		})
+		seg.recordsMtx.Unlock()
+		seg.inFlight.Done()
+
+		return AppendResult{Start: start, Length: length}, nil
+	}
+}
+
+// reserveBytes admits approxBytes against the in-flight byte budget,
+// returning false without reserving anything if the budget would be
+// exceeded. A caller that successfully reserves but then fails to write
+// must releaseBytes the same amount so the budget doesn't leak.
+func (m *WALManager) reserveBytes(approxBytes int64) bool {
+	m.inFlightBytesMtx.Lock()
+	defer m.inFlightBytesMtx.Unlock()
+
+	if m.cfg.MaxInFlightBytes > 0 && m.inFlightBytes+approxBytes > m.cfg.MaxInFlightBytes {
+		return false
+	}
+	m.inFlightBytes += approxBytes
+	return true
+}
+
+// releaseBytes returns approxBytes to the in-flight byte budget.
+func (m *WALManager) releaseBytes(approxBytes int64) {
+	m.inFlightBytesMtx.Lock()
+	m.inFlightBytes -= approxBytes
+	m.inFlightBytesMtx.Unlock()
+}
+
+// segmentForLocked returns the tenant's open segment, creating one if this
+// is the tenant's first append since the last Close. Callers must hold m.mtx.
+func (m *WALManager) segmentForLocked(tenant string) (*tenantSegment, error) {
+	if seg, ok := m.open[tenant]; ok {
+		return seg, nil
+	}
+
+	block, err := m.wal.NewBlock(uuid.New(), tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &tenantSegment{
+		block:       block,
+		symbolTable: wal.NewSymbolTable(),
+		opened:      time.Now(),
+	}
+	m.open[tenant] = seg
+
+	return seg, nil
+}
+
+// Close rotates the tenant's open segment, pushing it onto the finished
+// queue in completion order, and returns true if there was a segment to
+// close.
+func (m *WALManager) Close(tenant string) bool {
+	m.mtx.Lock()
+	seg, ok := m.open[tenant]
+	if !ok {
+		m.mtx.Unlock()
+		return false
+	}
+	delete(m.open, tenant)
+	m.mtx.Unlock()
+
+	m.closeSegment(tenant, seg)
+	return true
+}
+
+// closeSegment finalizes seg, which the caller must have already removed
+// from m.open so no new Append can resolve it. It still has to wait for
+// any Append that resolved seg before the removal and is mid-write: those
+// register themselves via seg.inFlight before this function's closed flag
+// can turn them away, so waiting on it here is enough to guarantee no
+// write lands after the symbol table is finalized and records/bytes are
+// snapshotted.
+func (m *WALManager) closeSegment(tenant string, seg *tenantSegment) {
+	seg.recordsMtx.Lock()
+	seg.closed = true
+	seg.recordsMtx.Unlock()
+
+	seg.inFlight.Wait()
+
+	seg.recordsMtx.Lock()
+	seg.symbolTable.Finalize()
+	records := seg.records
+	bytes := seg.bytes
+	seg.recordsMtx.Unlock()
+
+	m.releaseBytes(bytes)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.sequence++
+	fin := &finishedSegment{
+		sequence:    m.sequence,
+		tenant:      tenant,
+		records:     records,
+		block:       seg.block,
+		symbolTable: seg.symbolTable,
+	}
+
+	q, ok := m.finished[tenant]
+	if !ok {
+		q = &finishedQueue{}
+		heap.Init(q)
+		m.finished[tenant] = q
+	}
+	heap.Push(q, fin)
+}
+
+// PopFinished returns the oldest finished segment for tenant, if any.
+func (m *WALManager) PopFinished(tenant string) (*finishedSegment, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	q, ok := m.finished[tenant]
+	if !ok || q.Len() == 0 {
+		return nil, false
+	}
+
+	return heap.Pop(q).(*finishedSegment), true
+}
+
+// SymbolTableStats returns the size and entry count of tenant's open
+// segment's symbol table, for the ingester_block_symbol_table_* metrics.
+func (m *WALManager) SymbolTableStats(tenant string) (size int, entries int) {
+	m.mtx.Lock()
+	seg, ok := m.open[tenant]
+	m.mtx.Unlock()
+	if !ok {
+		return 0, 0
+	}
+
+	return seg.symbolTable.Size(), seg.symbolTable.Len()
+}
+
+// OpenSegmentRecordCount returns the number of trace records already
+// written to tenant's open segment, for the block_trace_records span
+// attribute. It returns 0 if there is no open segment.
+func (m *WALManager) OpenSegmentRecordCount(tenant string) int {
+	m.mtx.Lock()
+	seg, ok := m.open[tenant]
+	m.mtx.Unlock()
+	if !ok {
+		return 0
+	}
+
+	seg.recordsMtx.Lock()
+	defer seg.recordsMtx.Unlock()
+	return len(seg.records)
+}
+
+// IsReady reports whether tenant's open segment has grown old or large
+// enough to be cut, mirroring the thresholds instance.IsBlockReady used
+// to check against its own lastBlockCut.
+func (m *WALManager) IsReady(tenant string, maxTraces int, maxAge time.Duration) bool {
+	m.mtx.Lock()
+	seg, ok := m.open[tenant]
+	m.mtx.Unlock()
+	if !ok {
+		return false
+	}
+
+	seg.recordsMtx.Lock()
+	recordCount := len(seg.records)
+	seg.recordsMtx.Unlock()
+
+	return recordCount >= maxTraces || time.Since(seg.opened) >= maxAge
+}
+
+// flushLoop periodically closes segments that have aged out or reached
+// MaxSegmentTraces, even without an explicit Close call.
+func (m *WALManager) flushLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.rotateStale()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *WALManager) rotateStale() {
+	type pending struct {
+		tenant string
+		seg    *tenantSegment
+	}
+
+	m.mtx.Lock()
+	var toClose []pending
+	for tenant, seg := range m.open {
+		seg.recordsMtx.Lock()
+		full := m.cfg.MaxSegmentTraces > 0 && len(seg.records) >= m.cfg.MaxSegmentTraces
+		seg.recordsMtx.Unlock()
+
+		stale := time.Since(seg.opened) >= m.cfg.MaxSegmentAge
+		if stale || full {
+			toClose = append(toClose, pending{tenant: tenant, seg: seg})
+			delete(m.open, tenant)
+		}
+	}
+	m.mtx.Unlock()
+
+	for _, p := range toClose {
+		m.closeSegment(p.tenant, p.seg)
+	}
+}
+
+// Shutdown stops the flush loop. It does not close open segments; callers
+// should Close(tenant) explicitly for every tenant first if a final flush
+// is required.
+func (m *WALManager) Shutdown() {
+	close(m.quit)
+}
+
+// insertRecordSorted inserts r into records, keeping the descending
+// TraceID order the previous per-instance sort.Search insertion
+// maintained.
+func insertRecordSorted(records []*storage.TraceRecord, r *storage.TraceRecord) []*storage.TraceRecord {
+	idx := sort.Search(len(records), func(idx int) bool {
+		return bytes.Compare(records[idx].TraceID, r.TraceID) == -1
+	})
+	records = append(records, nil)
+	copy(records[idx+1:], records[idx:])
+	records[idx] = r
+	return records
+}
@@ -0,0 +1,99 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWALManagerReserveReleaseBytes guards the in-flight byte budget
+// accounting Append relies on: a reservation that isn't followed by a
+// successful write must be released, or the budget leaks until the
+// process restarts.
+func TestWALManagerReserveReleaseBytes(t *testing.T) {
+	m := &WALManager{cfg: WALManagerConfig{MaxInFlightBytes: 100}}
+
+	if ok := m.reserveBytes(60); !ok {
+		t.Fatalf("reserveBytes(60) = false, want true with 100 byte budget")
+	}
+	if ok := m.reserveBytes(60); ok {
+		t.Fatalf("reserveBytes(60) = true, want false once 120 > 100 byte budget")
+	}
+
+	// Simulate Append rolling back a reservation after a downstream
+	// failure (segment lookup or block write).
+	m.releaseBytes(60)
+
+	if ok := m.reserveBytes(60); !ok {
+		t.Fatalf("reserveBytes(60) = false after release, want true: budget appears to have leaked")
+	}
+}
+
+// TestTenantSegmentCloseWaitsForInFlightAppend checks the tenantSegment
+// closed/inFlight protocol that Append and closeSegment share: a write
+// that registered itself as in-flight before the segment was marked closed
+// must be allowed to finish, and its result must be visible, before close
+// finalizes the segment. The test replays both sides' steps inline on a
+// bare tenantSegment; it does not call Append or closeSegment. This is the
+// fix for a TOCTOU race where closeLocked used to read
+// seg.records/seg.bytes without anything serializing against such a write.
+func TestTenantSegmentCloseWaitsForInFlightAppend(t *testing.T) {
+	seg := &tenantSegment{}
+
+	seg.recordsMtx.Lock()
+	if seg.closed {
+		t.Fatalf("segment appeared closed before the test closed it")
+	}
+	seg.inFlight.Add(1)
+	seg.recordsMtx.Unlock()
+
+	closeStarted := make(chan struct{})
+	closeDone := make(chan struct{})
+	go func() {
+		seg.recordsMtx.Lock()
+		seg.closed = true
+		seg.recordsMtx.Unlock()
+		close(closeStarted)
+
+		seg.inFlight.Wait()
+		close(closeDone)
+	}()
+
+	<-closeStarted
+	select {
+	case <-closeDone:
+		t.Fatalf("close finished before the in-flight write finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	seg.recordsMtx.Lock()
+	seg.bytes += 42
+	seg.recordsMtx.Unlock()
+	seg.inFlight.Done()
+
+	<-closeDone
+	if seg.bytes != 42 {
+		t.Fatalf("seg.bytes = %d, want 42: the in-flight write must be visible before close finalizes the segment", seg.bytes)
+	}
+}
+
+// TestTenantSegmentRejectsAppendAfterClose covers the other half of the
+// same protocol: an Append that resolves a segment only after it has
+// already been marked closed must not register itself as in-flight, so it
+// knows to retry against a freshly opened segment instead of writing into
+// one already handed off to the finished queue. Like the test above, it
+// replays Append's closed check inline on a tenantSegment rather than
+// calling Append.
+func TestTenantSegmentRejectsAppendAfterClose(t *testing.T) {
+	seg := &tenantSegment{closed: true}
+
+	seg.recordsMtx.Lock()
+	closed := seg.closed
+	if !closed {
+		seg.inFlight.Add(1)
+	}
+	seg.recordsMtx.Unlock()
+
+	if !closed {
+		t.Fatalf("seg.closed = false, want true: a closed segment must be rejected so Append retries")
+	}
+}